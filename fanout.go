@@ -0,0 +1,605 @@
+// A client implementation that fans a single shared buffer out to
+// several logplex endpoints concurrently (e.g. a primary and a
+// standby, or a mirror for migration), merging their responses into
+// one outcome without duplicating buffering, syslog framing, or the
+// token-bucket concurrency limiter.
+package logplexc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QuorumPolicy decides how many endpoints must agree before a
+// fanned-out POST is counted as successful.
+type QuorumPolicy int
+
+const (
+	// AnySuccess counts success if at least one endpoint returns
+	// 204.
+	AnySuccess QuorumPolicy = iota
+
+	// MajoritySuccess counts success if more than half of the
+	// endpoints return 204.
+	MajoritySuccess
+
+	// AllSuccess counts success only if every endpoint returns
+	// 204.
+	AllSuccess
+)
+
+// EndpointResult is one endpoint's outcome from a fanned-out POST.
+type EndpointResult struct {
+	StatusCode int
+	Err        error
+}
+
+// ResponseMerger decides the single HTTP-like status code to count
+// against the aggregate Stats, given the per-endpoint results of a
+// fanned-out POST and the quorum policy in effect. results is keyed
+// by endpoint URL, the same keys used in FanoutStatistics.Endpoints.
+//
+// Implementations can tailor how ambiguous cases are resolved, e.g.
+// a MajoritySuccess tie, or the primary's response not having come
+// back because it was hedged away. results always holds at least one
+// endpoint's result.
+type ResponseMerger interface {
+	Merge(policy QuorumPolicy, primary string, results map[string]EndpointResult) int
+}
+
+// quorumMerger is the default ResponseMerger: it counts success
+// against the quorum policy and, when the policy doesn't settle on a
+// concrete status to report, prefers the primary endpoint's status.
+type quorumMerger struct{}
+
+func (quorumMerger) Merge(policy QuorumPolicy, primary string, results map[string]EndpointResult) int {
+	total := len(results)
+	successes := 0
+	for _, r := range results {
+		if r.Err == nil && r.StatusCode == http.StatusNoContent {
+			successes++
+		}
+	}
+
+	met := false
+	switch policy {
+	case AnySuccess:
+		met = successes >= 1
+	case MajoritySuccess:
+		met = successes*2 > total
+	case AllSuccess:
+		met = successes == total && total > 0
+	}
+
+	if met {
+		return http.StatusNoContent
+	}
+
+	if r, ok := results[primary]; ok && r.Err == nil {
+		return r.StatusCode
+	}
+
+	// No clear signal from the primary; fall back to any other
+	// endpoint's non-transport-error status. results is a map, so
+	// which one is picked when several qualify is not defined.
+	for _, r := range results {
+		if r.Err == nil {
+			return r.StatusCode
+		}
+	}
+
+	return 0
+}
+
+// FanoutEndpoint is one logplex destination in a FanoutClient.
+type FanoutEndpoint struct {
+	Logplex url.URL
+
+	// Token is used only for this endpoint's HTTP Basic Auth
+	// credentials; it never appears in the syslog framing, which
+	// is done once, up front, against the shared buffer. See
+	// FanoutConfig.Token.
+	Token string
+}
+
+type FanoutConfig struct {
+	Endpoints          []FanoutEndpoint
+	HttpClient         http.Client
+	RequestSizeTrigger int
+	Concurrency        int
+	TargetLogLatency   time.Duration
+	Retry              RetryPolicy
+	Quorum             QuorumPolicy
+
+	// Token is embedded in the syslog frame of every buffered
+	// message, the same way a single Config.Token is for a plain
+	// Client; since framing happens once against the shared
+	// buffer rather than per endpoint, there is exactly one
+	// framing token regardless of how many Endpoints are
+	// configured. Each FanoutEndpoint.Token is separate and used
+	// only for that endpoint's HTTP Basic Auth.
+	Token string
+
+	// Merger decides the aggregate status from per-endpoint
+	// results. Defaults to a merger that honors Quorum and falls
+	// back to the first configured endpoint's status when the
+	// quorum rule alone is ambiguous.
+	Merger ResponseMerger
+
+	// Pool the shared outbox buffer is drawn from and returned to;
+	// see MiniConfig.BufferPool.
+	BufferPool BufferPool
+
+	// Sink that latency/bandwidth/counter observations are
+	// forwarded to; see Config.Metrics. Counters are forwarded for
+	// the merged outcome only; latency and bytes are forwarded for
+	// every endpoint's POST, without saying which endpoint they
+	// came from.
+	Metrics MetricsSink
+}
+
+// FanoutStatistics is the result of FanoutClient.Statistics(): the
+// merged outcome alongside each endpoint's own view, so operators can
+// tell a generally-healthy fanout apart from one standby endpoint
+// quietly failing.
+type FanoutStatistics struct {
+	Merged    Stats
+	Endpoints map[string]Stats
+}
+
+type FanoutClient struct {
+	Stats
+	statLock sync.Mutex
+
+	endpoints    []*MiniClient
+	endpointKeys []string
+	primary      string
+
+	endpointLock sync.Mutex
+	endpointStat map[string]Stats
+
+	// Buffering only; never Posted against directly. Endpoints
+	// are Posted to with the bytes this accrues.
+	buf *MiniClient
+
+	concurrency int32
+	bucket      chan bool
+
+	RequestSizeTrigger int
+	retry              RetryPolicy
+	targetLogLatency   time.Duration
+	quorum             QuorumPolicy
+	merger             ResponseMerger
+	metrics            MetricsSink
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	ticker   *time.Ticker
+	finalize chan bool
+}
+
+func NewFanoutClient(cfg *FanoutConfig) (*FanoutClient, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("logplexc.FanoutClient: at least one " +
+			"endpoint is required")
+	}
+
+	if cfg.TargetLogLatency < 0 {
+		return nil, errors.New("logplexc.FanoutClient: negative target " +
+			"latency not allowed")
+	}
+
+	endpoints := make([]*MiniClient, len(cfg.Endpoints))
+	keys := make([]string, len(cfg.Endpoints))
+	endpointStat := make(map[string]Stats, len(cfg.Endpoints))
+
+	for i, e := range cfg.Endpoints {
+		ep, err := NewMiniClient(&MiniConfig{
+			Logplex:    e.Logplex,
+			Token:      e.Token,
+			HttpClient: cfg.HttpClient,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints[i] = ep
+		keys[i] = e.Logplex.String()
+		endpointStat[keys[i]] = Stats{}
+	}
+
+	buf, err := NewMiniClient(&MiniConfig{
+		Token:      cfg.Token,
+		BufferPool: cfg.BufferPool,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	retry := cfg.Retry
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 1
+	}
+
+	merger := cfg.Merger
+	if merger == nil {
+		merger = quorumMerger{}
+	}
+
+	metrics := cfg.Metrics
+	if metrics == nil {
+		metrics = NopMetricsSink{}
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	fc := FanoutClient{
+		endpoints:          endpoints,
+		endpointKeys:       keys,
+		primary:            keys[0],
+		endpointStat:       endpointStat,
+		buf:                buf,
+		finalize:           make(chan bool),
+		bucket:             make(chan bool),
+		RequestSizeTrigger: cfg.RequestSizeTrigger,
+		retry:              retry,
+		targetLogLatency:   cfg.TargetLogLatency,
+		quorum:             cfg.Quorum,
+		merger:             merger,
+		metrics:            metrics,
+		ctx:                ctx,
+		cancel:             cancel,
+	}
+
+	if cfg.TargetLogLatency > 0 {
+		fc.ticker = time.NewTicker(cfg.TargetLogLatency)
+	}
+
+	go func() {
+		for i := 0; i < cfg.Concurrency; i += 1 {
+			fc.bucket <- true
+		}
+	}()
+
+	if fc.ticker != nil {
+		go func() {
+			for {
+				select {
+				case <-fc.ticker.C:
+				case _, _ = <-fc.finalize:
+					return
+				}
+
+				go fc.syncWorker()
+			}
+		}()
+	}
+
+	return &fc, nil
+}
+
+func (fc *FanoutClient) Close() {
+	// ticker is left nil when TargetLogLatency is zero.
+	if fc.ticker != nil {
+		fc.ticker.Stop()
+	}
+	close(fc.finalize)
+	fc.cancel(ErrClientClosed)
+}
+
+func (fc *FanoutClient) BufferMessage(
+	ctx context.Context, when time.Time, host string, procId string, log []byte) error {
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case _, _ = <-fc.finalize:
+		return errors.New("Failed trying to buffer a message: " +
+			"client already Closed")
+	default:
+		// no-op
+	}
+
+	s := fc.buf.BufferMessage(when, host, procId, log)
+	if s.Buffered >= fc.RequestSizeTrigger || fc.ticker == nil {
+		go fc.syncWorker()
+	}
+
+	return nil
+}
+
+func (fc *FanoutClient) Statistics() FanoutStatistics {
+	fc.statLock.Lock()
+	merged := fc.Stats
+	fc.statLock.Unlock()
+
+	fc.endpointLock.Lock()
+	defer fc.endpointLock.Unlock()
+
+	endpoints := make(map[string]Stats, len(fc.endpointStat))
+	for k, v := range fc.endpointStat {
+		endpoints[k] = v
+	}
+
+	return FanoutStatistics{Merged: merged, Endpoints: endpoints}
+}
+
+func (fc *FanoutClient) syncWorker() {
+	atomic.AddInt32(&fc.Stats.Concurrency, 1)
+	defer atomic.AddInt32(&fc.Stats.Concurrency, -1)
+
+	b := fc.buf.SwapBundle()
+
+	// Avoid sending empty requests
+	if b.NumberFramed <= 0 {
+		return
+	}
+
+	select {
+	case <-fc.bucket:
+		defer func() {
+			fc.bucket <- true
+		}()
+	default:
+		fc.statReqDrop(&b.MiniStats)
+		fc.buf.ReleaseBundle(&b)
+		return
+	}
+
+	// The payload is read-only from here on: SwapBundle detached
+	// it from future buffering, so every endpoint can safely read
+	// its own bytes.Reader over the same backing array
+	// concurrently.
+	payload := b.outbox.Bytes()
+	fc.statBytesFramed(len(payload))
+
+	hedgeCtx, hedgeCancel := context.WithCancel(fc.ctx)
+	defer hedgeCancel()
+
+	type outcome struct {
+		key string
+		res EndpointResult
+	}
+
+	out := make(chan outcome, len(fc.endpoints))
+
+	for i, ep := range fc.endpoints {
+		go func(ep *MiniClient, key string) {
+			resp, retries, err := fc.postWithRetry(hedgeCtx, ep, payload, b.NumberFramed)
+			fc.statBytesSent(len(payload) * (retries + 1))
+
+			res := EndpointResult{}
+			if err != nil {
+				res.Err = err
+			} else {
+				res.StatusCode = resp.StatusCode
+				resp.Body.Close()
+			}
+
+			fc.statEndpoint(key, &b.MiniStats, res, retries)
+			out <- outcome{key, res}
+		}(ep, fc.endpointKeys[i])
+	}
+
+	results := make(map[string]EndpointResult, len(fc.endpoints))
+	remaining := len(fc.endpoints)
+
+	for remaining > 0 {
+		o := <-out
+		results[o.key] = o.res
+		remaining--
+
+		if fc.quorumDecided(results, remaining) {
+			// Quorum is already settled one way or the
+			// other; hedge away the stragglers instead of
+			// letting a slow endpoint hold up a fast one.
+			hedgeCancel()
+			break
+		}
+	}
+
+	if remaining > 0 {
+		// Stragglers were hedged away, but their requests may
+		// still be reading the shared payload; only release it
+		// back to the pool once every one of them has actually
+		// returned.
+		go func(left int) {
+			for left > 0 {
+				<-out
+				left--
+			}
+			fc.buf.ReleaseBundle(&b)
+		}(remaining)
+	} else {
+		fc.buf.ReleaseBundle(&b)
+	}
+
+	status := fc.merger.Merge(fc.quorum, fc.primary, results)
+
+	if status == http.StatusNoContent {
+		fc.statReqSuccess(&b.MiniStats)
+	} else {
+		fc.statReqRej(&b.MiniStats)
+	}
+}
+
+// quorumDecided reports whether the outcome is already settled given
+// the results seen so far and how many endpoints are still
+// outstanding, so the caller can stop waiting on stragglers as soon
+// as their answer couldn't change the merged outcome.
+func (fc *FanoutClient) quorumDecided(results map[string]EndpointResult, remaining int) bool {
+	total := len(fc.endpoints)
+
+	successes := 0
+	for _, r := range results {
+		if r.Err == nil && r.StatusCode == http.StatusNoContent {
+			successes++
+		}
+	}
+
+	switch fc.quorum {
+	case AnySuccess:
+		return successes >= 1 || remaining == 0
+	case MajoritySuccess:
+		return successes*2 > total || (successes+remaining)*2 <= total
+	case AllSuccess:
+		// Unlike AnySuccess/MajoritySuccess, the aggregate answer
+		// here can't change what hedging would buy: dual-shipping
+		// to a primary and a standby needs every endpoint's
+		// delivery to actually complete, not just the aggregate
+		// status to be known. Hedging away stragglers as soon as
+		// one endpoint fails would let a flaky primary suppress
+		// delivery to an otherwise-healthy standby, so never
+		// settle early for this policy.
+		return remaining == 0
+	default:
+		return remaining == 0
+	}
+}
+
+// postWithRetry posts payload to a single endpoint, retrying
+// retriable failures according to fc.retry until one succeeds, the
+// policy is exhausted, the retry deadline (derived from
+// TargetLogLatency) elapses, ctx is cancelled (e.g. by a hedge that
+// no longer needs this endpoint), or the client is Closed.
+func (fc *FanoutClient) postWithRetry(
+	ctx context.Context, ep *MiniClient, payload []byte, numberFramed uint64,
+) (resp *http.Response, retries int, err error) {
+	var deadline time.Time
+	if fc.targetLogLatency > 0 {
+		deadline = time.Now().Add(fc.targetLogLatency)
+	}
+
+	delay := fc.retry.InitialDelay
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err = ep.PostPayload(ctx, bytes.NewReader(payload), numberFramed)
+		fc.statLatency(time.Since(start))
+
+		if !isRetriable(resp, err) || attempt+1 >= fc.retry.MaxAttempts {
+			return resp, attempt, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		wait := jitter(delay, fc.retry.Jitter)
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return resp, attempt, err
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return resp, attempt, err
+		case <-fc.finalize:
+			return resp, attempt, err
+		}
+
+		delay = time.Duration(float64(delay) * fc.retry.Multiplier)
+		if fc.retry.MaxDelay > 0 && delay > fc.retry.MaxDelay {
+			delay = fc.retry.MaxDelay
+		}
+	}
+}
+
+func (fc *FanoutClient) statReqTotalUnsync(s *MiniStats) {
+	fc.Total += s.NumberFramed
+	fc.TotalRequests += 1
+}
+
+func (fc *FanoutClient) statReqSuccess(s *MiniStats) {
+	fc.statLock.Lock()
+	defer fc.statLock.Unlock()
+	fc.statReqTotalUnsync(s)
+
+	fc.Successful += s.NumberFramed
+	fc.SuccessRequests += 1
+	fc.metrics.IncrCounter("successful", s.NumberFramed)
+}
+
+func (fc *FanoutClient) statReqRej(s *MiniStats) {
+	fc.statLock.Lock()
+	defer fc.statLock.Unlock()
+	fc.statReqTotalUnsync(s)
+
+	fc.Rejected += s.NumberFramed
+	fc.RejectRequests += 1
+	fc.metrics.IncrCounter("rejected", s.NumberFramed)
+}
+
+func (fc *FanoutClient) statLatency(d time.Duration) {
+	fc.statLock.Lock()
+	fc.Latency.observe(uint64(d.Milliseconds()))
+	fc.statLock.Unlock()
+
+	fc.metrics.ObserveLatency(d)
+}
+
+func (fc *FanoutClient) statBytesFramed(framedLen int) {
+	fc.statLock.Lock()
+	fc.BytesFramed += uint64(framedLen)
+	fc.statLock.Unlock()
+}
+
+// statBytesSent accounts bytes actually placed on the wire for one
+// endpoint's POST, including every retry of it; see Client.statBytes,
+// which does the equivalent for the single-endpoint case.
+func (fc *FanoutClient) statBytesSent(sent int) {
+	fc.statLock.Lock()
+	fc.BytesSent += uint64(sent)
+	fc.statLock.Unlock()
+
+	fc.metrics.ObserveBytes(sent)
+}
+
+func (fc *FanoutClient) statReqDrop(s *MiniStats) {
+	fc.statLock.Lock()
+	defer fc.statLock.Unlock()
+	fc.statReqTotalUnsync(s)
+
+	fc.Dropped += s.NumberFramed
+	fc.DroppedRequests += 1
+	fc.metrics.IncrCounter("dropped", s.NumberFramed)
+}
+
+func (fc *FanoutClient) statEndpoint(
+	key string, s *MiniStats, res EndpointResult, retries int) {
+
+	fc.endpointLock.Lock()
+	defer fc.endpointLock.Unlock()
+
+	st := fc.endpointStat[key]
+	st.Total += s.NumberFramed
+	st.TotalRequests += 1
+	st.Retries += uint64(retries)
+
+	switch {
+	case res.Err != nil:
+		st.Cancelled += s.NumberFramed
+		st.CancelRequests += 1
+	case res.StatusCode == http.StatusNoContent:
+		st.Successful += s.NumberFramed
+		st.SuccessRequests += 1
+	default:
+		st.Rejected += s.NumberFramed
+		st.RejectRequests += 1
+	}
+
+	fc.endpointStat[key] = st
+}
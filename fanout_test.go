@@ -0,0 +1,364 @@
+package logplexc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// statusByURLTripper responds to each request with the status code
+// registered for its URL, or 204 if the URL isn't registered. It also
+// records how many times each URL was requested, so a test can tell
+// whether an endpoint was actually hit or hedged away.
+type statusByURLTripper struct {
+	status map[string]int
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (t *statusByURLTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// NewMiniClient embeds the endpoint's token as Basic Auth
+	// userinfo in its copy of the Logplex URL, so the request's
+	// URL (unlike the FanoutEndpoint.Logplex it was configured
+	// with) carries credentials; key on host+path, which don't.
+	key := req.URL.Host + req.URL.Path
+
+	t.mu.Lock()
+	if t.calls == nil {
+		t.calls = map[string]int{}
+	}
+	t.calls[key]++
+	t.mu.Unlock()
+
+	code := http.StatusNoContent
+	if c, ok := t.status[key]; ok {
+		code = c
+	}
+
+	return &http.Response{
+		StatusCode: code,
+		Body:       &ClosableBuffer{},
+	}, nil
+}
+
+// blockUntilCanceledTripper never responds on its own: it blocks
+// until the request's context is cancelled, then reports that as a
+// transport error, the way a real http.Client would for a hedged-away
+// request.
+type blockUntilCanceledTripper struct{}
+
+func (blockUntilCanceledTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func mustParseURL(t *testing.T, raw string) url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("could not parse %q: %v", raw, err)
+	}
+	return *u
+}
+
+// hostPath returns the part of a URL that survives NewMiniClient
+// embedding Basic Auth credentials into its copy of it, so tests can
+// match an endpoint's configured URL against the URL an outgoing
+// request actually carries.
+func hostPath(u url.URL) string {
+	return u.Host + u.Path
+}
+
+// newTestFanoutClient builds a FanoutClient the way NewFanoutClient
+// would, except its token bucket is a buffered channel pre-loaded
+// with a single token, so syncWorker can be called synchronously from
+// a test without racing the background goroutine NewFanoutClient
+// would otherwise use to supply it.
+func newTestFanoutClient(t *testing.T, endpoints []FanoutEndpoint, quorum QuorumPolicy, transport http.RoundTripper) *FanoutClient {
+	client := *http.DefaultClient
+	client.Transport = transport
+
+	miniEndpoints := make([]*MiniClient, len(endpoints))
+	keys := make([]string, len(endpoints))
+	endpointStat := make(map[string]Stats, len(endpoints))
+
+	for i, e := range endpoints {
+		ep, err := NewMiniClient(&MiniConfig{
+			Logplex:    e.Logplex,
+			Token:      e.Token,
+			HttpClient: client,
+		})
+		if err != nil {
+			t.Fatalf("could not construct endpoint MiniClient: %v", err)
+		}
+
+		miniEndpoints[i] = ep
+		keys[i] = e.Logplex.String()
+		endpointStat[keys[i]] = Stats{}
+	}
+
+	buf, err := NewMiniClient(&MiniConfig{Token: "framing-token"})
+	if err != nil {
+		t.Fatalf("could not construct framing MiniClient: %v", err)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	fc := &FanoutClient{
+		endpoints:    miniEndpoints,
+		endpointKeys: keys,
+		primary:      keys[0],
+		endpointStat: endpointStat,
+		buf:          buf,
+		bucket:       make(chan bool, 1),
+		finalize:     make(chan bool),
+		retry:        RetryPolicy{MaxAttempts: 1},
+		quorum:       quorum,
+		merger:       quorumMerger{},
+		metrics:      NopMetricsSink{},
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	fc.bucket <- true
+
+	return fc
+}
+
+func TestQuorumMergerMerge(t *testing.T) {
+	primary := "primary"
+	standby := "standby"
+
+	tests := []struct {
+		name    string
+		policy  QuorumPolicy
+		results map[string]EndpointResult
+		want    int
+	}{
+		{
+			name:   "AnySuccess with one success",
+			policy: AnySuccess,
+			results: map[string]EndpointResult{
+				primary: {StatusCode: http.StatusInternalServerError},
+				standby: {StatusCode: http.StatusNoContent},
+			},
+			want: http.StatusNoContent,
+		},
+		{
+			name:   "AllSuccess with one failure falls back to primary",
+			policy: AllSuccess,
+			results: map[string]EndpointResult{
+				primary: {StatusCode: http.StatusInternalServerError},
+				standby: {StatusCode: http.StatusNoContent},
+			},
+			want: http.StatusInternalServerError,
+		},
+		{
+			name:   "MajoritySuccess with a tie falls back to primary",
+			policy: MajoritySuccess,
+			results: map[string]EndpointResult{
+				primary: {StatusCode: http.StatusInternalServerError},
+				standby: {StatusCode: http.StatusNoContent},
+			},
+			want: http.StatusInternalServerError,
+		},
+		{
+			name:   "primary errored falls back to another endpoint's status",
+			policy: AnySuccess,
+			results: map[string]EndpointResult{
+				primary: {Err: context.Canceled},
+				standby: {StatusCode: http.StatusBadGateway},
+			},
+			want: http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := (quorumMerger{}).Merge(tc.policy, primary, tc.results)
+			if got != tc.want {
+				t.Errorf("Merge() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFanoutClientQuorumDecided exercises
+// quorumDecided directly against a bare FanoutClient, without any
+// HTTP machinery, covering the hedge-early-exit rule for each policy
+// and specifically guarding the AllSuccess case: a straggler must
+// always be waited on, since its delivery can't be hedged away.
+func TestFanoutClientQuorumDecided(t *testing.T) {
+	fc := &FanoutClient{endpoints: make([]*MiniClient, 3)}
+
+	tests := []struct {
+		name      string
+		quorum    QuorumPolicy
+		results   map[string]EndpointResult
+		remaining int
+		want      bool
+	}{
+		{
+			name:      "AnySuccess settles as soon as one succeeds",
+			quorum:    AnySuccess,
+			results:   map[string]EndpointResult{"a": {StatusCode: http.StatusNoContent}},
+			remaining: 2,
+			want:      true,
+		},
+		{
+			name:      "AllSuccess does not settle early even after a failure",
+			quorum:    AllSuccess,
+			results:   map[string]EndpointResult{"a": {StatusCode: http.StatusInternalServerError}},
+			remaining: 2,
+			want:      false,
+		},
+		{
+			name:   "AllSuccess settles once every endpoint has reported",
+			quorum: AllSuccess,
+			results: map[string]EndpointResult{
+				"a": {StatusCode: http.StatusNoContent},
+				"b": {StatusCode: http.StatusNoContent},
+				"c": {StatusCode: http.StatusNoContent},
+			},
+			remaining: 0,
+			want:      true,
+		},
+		{
+			name:      "MajoritySuccess settles once a majority can no longer be reached",
+			quorum:    MajoritySuccess,
+			results:   map[string]EndpointResult{"a": {StatusCode: http.StatusInternalServerError}},
+			remaining: 1,
+			want:      true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fc.quorum = tc.quorum
+			if got := fc.quorumDecided(tc.results, tc.remaining); got != tc.want {
+				t.Errorf("quorumDecided() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFanoutClientSyncWorkerMergesEndpointStats drives a real
+// syncWorker pass across two endpoints with different outcomes and
+// checks both the merged Stats and the per-endpoint breakdown in
+// FanoutStatistics.Endpoints.
+func TestFanoutClientSyncWorkerMergesEndpointStats(t *testing.T) {
+	primaryURL := mustParseURL(t, "https://primary.test/logs")
+	standbyURL := mustParseURL(t, "https://standby.test/logs")
+
+	tripper := &statusByURLTripper{
+		status: map[string]int{
+			hostPath(standbyURL): http.StatusInternalServerError,
+		},
+	}
+
+	fc := newTestFanoutClient(t, []FanoutEndpoint{
+		{Logplex: primaryURL, Token: "primary-token"},
+		{Logplex: standbyURL, Token: "standby-token"},
+	}, AnySuccess, tripper)
+
+	fc.buf.BufferMessage(time.Now(), "UK", "CharlesDickens", []byte("hello"))
+	fc.syncWorker()
+
+	stats := fc.Statistics()
+
+	if stats.Merged.SuccessRequests != 1 {
+		t.Errorf("expected merged SuccessRequests=1 under AnySuccess, got %+v", stats.Merged)
+	}
+
+	primaryStat, ok := stats.Endpoints[primaryURL.String()]
+	if !ok {
+		t.Fatalf("no stats recorded for primary endpoint %q: %v", primaryURL.String(), stats.Endpoints)
+	}
+	if primaryStat.SuccessRequests != 1 {
+		t.Errorf("expected primary SuccessRequests=1, got %+v", primaryStat)
+	}
+
+	// Under AnySuccess, syncWorker returns as soon as the primary
+	// succeeds, so the standby's stats may only land after it has
+	// returned; give them a moment.
+	var standbyStat Stats
+	deadline := time.Now().Add(time.Second)
+	for {
+		endpoints := fc.Statistics().Endpoints
+		standbyStat, ok = endpoints[standbyURL.String()]
+		if !ok {
+			t.Fatalf("no stats recorded for standby endpoint %q: %v", standbyURL.String(), endpoints)
+		}
+		if standbyStat.RejectRequests > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if standbyStat.RejectRequests != 1 {
+		t.Errorf("expected standby RejectRequests=1, got %+v", standbyStat)
+	}
+}
+
+// TestFanoutClientHedgesAwayStragglerUnderAnySuccess checks that a
+// slow endpoint doesn't hold up a fanned-out POST under AnySuccess:
+// syncWorker must return as soon as the fast endpoint succeeds, and
+// the straggler's request must then be cancelled rather than left to
+// run to completion.
+func TestFanoutClientHedgesAwayStragglerUnderAnySuccess(t *testing.T) {
+	fastURL := mustParseURL(t, "https://fast.test/logs")
+	slowURL := mustParseURL(t, "https://slow.test/logs")
+
+	tripper := &statusByURLTripper{status: map[string]int{}}
+
+	slowTransport := func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host+req.URL.Path == hostPath(slowURL) {
+			return blockUntilCanceledTripper{}.RoundTrip(req)
+		}
+		return tripper.RoundTrip(req)
+	}
+
+	fc := newTestFanoutClient(t, []FanoutEndpoint{
+		{Logplex: fastURL, Token: "fast-token"},
+		{Logplex: slowURL, Token: "slow-token"},
+	}, AnySuccess, roundTripFunc(slowTransport))
+
+	fc.buf.BufferMessage(time.Now(), "UK", "CharlesDickens", []byte("hello"))
+
+	done := make(chan bool)
+	go func() {
+		fc.syncWorker()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("syncWorker did not return promptly; the slow endpoint was not hedged away")
+	}
+
+	if stats := fc.Statistics().Merged; stats.SuccessRequests != 1 {
+		t.Errorf("expected merged SuccessRequests=1, got %+v", stats)
+	}
+
+	// The straggler's request is drained in the background once
+	// it actually returns (having been cancelled); give it a
+	// moment to land before checking its stats.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if s, ok := fc.Statistics().Endpoints[slowURL.String()]; ok && s.CancelRequests > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected the hedged-away endpoint to eventually report a cancelled request, got %+v",
+		fc.Statistics().Endpoints[slowURL.String()])
+}
+
+// roundTripFunc adapts a function to http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
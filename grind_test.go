@@ -2,11 +2,14 @@ package logplexc
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -32,6 +35,31 @@ func (n *NoopTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	return &resp, nil
 }
 
+// bodyLenTripper records the length of each request body it actually
+// receives and always responds 204, so a test can tell whether an
+// attempt that reached the transport carried a full payload or an
+// empty one.
+type bodyLenTripper struct {
+	mu       sync.Mutex
+	bodyLens []int
+}
+
+func (t *bodyLenTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.bodyLens = append(t.bodyLens, len(body))
+	t.mu.Unlock()
+
+	return &http.Response{
+		StatusCode: http.StatusNoContent,
+		Body:       &ClosableBuffer{},
+	}, nil
+}
+
 var BogusLogplexUrl url.URL
 
 func init() {
@@ -43,6 +71,77 @@ func init() {
 	BogusLogplexUrl = *url
 }
 
+// A synthetic transport failure (MiniConfig.FailRate) injected
+// mid-stream must not leave a later, real attempt sending a truncated
+// or empty body: postWithRetry resends the whole bundle on each
+// attempt rather than reusing an already-drained reader.
+func TestPostWithRetryResendsBodyOnRetry(t *testing.T) {
+	tripper := &bodyLenTripper{}
+
+	client := *http.DefaultClient
+	client.Transport = tripper
+
+	cfg := Config{
+		Logplex:          BogusLogplexUrl,
+		HttpClient:       client,
+		Concurrency:      1,
+		TargetLogLatency: 3 * time.Second,
+		Token:            "a-token",
+		FailRate:         0.5,
+		Retry: RetryPolicy{
+			MaxAttempts:  2,
+			InitialDelay: time.Millisecond,
+		},
+	}
+
+	c, err := NewClient(&cfg)
+	if err != nil {
+		t.Fatalf("Could not construct new client: %v", err)
+	}
+	defer c.Close()
+
+	// Call postWithRetry directly, bypassing BufferMessage's
+	// worker-pool dispatch, so FailRate's accumulator advances in
+	// a predictable order and isn't at the mercy of how many
+	// syncWorkers happen to be in flight.
+	//
+	// This first bundle lands on the "pass" half of the duty
+	// cycle and advances the accumulator to the brink of a
+	// failure, without one occurring itself.
+	c.c.BufferMessage(time.Now(), "UK", "CharlesDickens", []byte("warmup"))
+	warmup := c.c.SwapBundle()
+	if _, _, err := c.postWithRetry(&warmup); err != nil {
+		t.Fatalf("warmup post failed: %v", err)
+	}
+
+	// This bundle's first attempt falls on the "fail" half of the
+	// cycle and is retried; the retry falls back on the "pass"
+	// half and must carry the full body.
+	msg := []byte("It was the best of times, it was the worst of times")
+	c.c.BufferMessage(time.Now(), "UK", "CharlesDickens", msg)
+	b := c.c.SwapBundle()
+	_, retries, err := c.postWithRetry(&b)
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	if retries != 1 {
+		t.Fatalf("expected 1 retry, got %d", retries)
+	}
+
+	tripper.mu.Lock()
+	defer tripper.mu.Unlock()
+
+	if len(tripper.bodyLens) != 2 {
+		t.Fatalf("expected 2 requests to reach the transport (warmup "+
+			"+ retry), got %d: %v", len(tripper.bodyLens), tripper.bodyLens)
+	}
+	for i, n := range tripper.bodyLens {
+		if n == 0 {
+			t.Errorf("request %d reached the transport with an empty body", i)
+		}
+	}
+}
+
 // Try creating and tearing down lots of clients
 func BenchmarkStartup(b *testing.B) {
 	client := *http.DefaultClient
@@ -53,7 +152,7 @@ func BenchmarkStartup(b *testing.B) {
 		HttpClient:         client,
 		RequestSizeTrigger: 100,
 		Concurrency:        3,
-		Period:             3 * time.Second,
+		TargetLogLatency:   3 * time.Second,
 		Token:              "a-token",
 	}
 
@@ -84,6 +183,8 @@ present period, that some of its noisiest authorities insisted on its
 being received, for good or for evil, in the superlative degree of
 comparison only.`)
 
+	ctx := context.Background()
+
 	defer c.Close()
 	t := time.Now()
 
@@ -96,7 +197,7 @@ comparison only.`)
 	for i := 0; i < inputConcur; i += 1 {
 		go func() {
 			for i := 0; i < perGoroutinePayload; i += 1 {
-				c.BufferMessage(t, "UK", "CharlesDickens", log)
+				c.BufferMessage(ctx, t, "UK", "CharlesDickens", log)
 			}
 
 			done <- true
@@ -122,7 +223,7 @@ func NewNoopClient(f interface {
 		HttpClient:         client,
 		RequestSizeTrigger: sizeTrigger,
 		Concurrency:        3,
-		Period:             3 * time.Second,
+		TargetLogLatency:   3 * time.Second,
 		Token:              "a-token",
 	}
 
@@ -150,6 +251,39 @@ func BenchmarkFanInOut(b *testing.B) {
 	doFanInOutBench(b, NewNoopClient(b, 100*KB), 500)
 }
 
+func newNoopClientWithPool(f interface {
+	Fatalf(string, ...interface{})
+},
+	sizeTrigger int, pool BufferPool) *Client {
+	client := *http.DefaultClient
+	client.Transport = &NoopTripper{}
+
+	cfg := Config{
+		Logplex:            BogusLogplexUrl,
+		HttpClient:         client,
+		RequestSizeTrigger: sizeTrigger,
+		Concurrency:        3,
+		TargetLogLatency:   3 * time.Second,
+		Token:              "a-token",
+		BufferPool:         pool,
+	}
+
+	c, err := NewClient(&cfg)
+	if err != nil {
+		f.Fatalf("Could not construct new client: %v", err)
+	}
+
+	return c
+}
+
+func BenchmarkFanInOutPooled(b *testing.B) {
+	doFanInOutBench(b, newNoopClientWithPool(b, 100*KB, nil), 500)
+}
+
+func BenchmarkFanInOutNopPool(b *testing.B) {
+	doFanInOutBench(b, newNoopClientWithPool(b, 100*KB, NopBufferPool{}), 500)
+}
+
 // Try logging to a real, live endpoint URL and token, specified by
 // LOGPLEX_URL and LOGPLEX_TOKEN.
 //
@@ -193,7 +327,7 @@ func BenchmarkToUrl(b *testing.B) {
 		HttpClient:         client,
 		RequestSizeTrigger: 100 * KB,
 		Concurrency:        3,
-		Period:             3 * time.Second,
+		TargetLogLatency:   3 * time.Second,
 		Token:              token,
 	}
 
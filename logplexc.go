@@ -2,7 +2,10 @@
 package logplexc
 
 import (
+	"context"
 	"errors"
+	"io"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sync"
@@ -10,6 +13,33 @@ import (
 	"time"
 )
 
+// ErrClientClosed is the cancellation cause attached to a Client's
+// internal context when Close() is called. Compare against it with
+// Cause() to tell "the client was Closed" apart from a deadline
+// exceeded or a user cancel, without resorting to string-matching.
+var ErrClientClosed = errors.New("logplexc: client closed")
+
+// Cause reports why ctx was cancelled, unwrapping the *url.Error that
+// http.Client.Do wraps context cancellation errors in and preferring
+// the specific cause recorded by the CancelCauseFunc (e.g.
+// ErrClientClosed) over the generic context.Canceled/
+// DeadlineExceeded that ctx.Err() would report.
+func Cause(ctx context.Context, err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+
+	if err != context.Canceled && err != context.DeadlineExceeded {
+		return err
+	}
+
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+
+	return err
+}
+
 type Stats struct {
 	// Number of concurrent requests at the time of retrieval.
 	Concurrency int32
@@ -42,6 +72,70 @@ type Stats struct {
 	CancelRequests  uint64
 	RejectRequests  uint64
 	SuccessRequests uint64
+
+	// Retry statistics. These are incremented in addition to, not
+	// instead of, the counters above, so operators can see how
+	// much retrying is contributing to an otherwise-unchanged
+	// success/rejection/cancellation picture.
+
+	// Incremented once per retried attempt (i.e. every attempt
+	// after the first) of a POST.
+	Retries uint64
+
+	// Incremented when a bundle only succeeded after one or more
+	// retries.
+	RetriedSuccess uint64
+
+	// Incremented when a bundle exhausted its retry policy
+	// without ever getting a successful response.
+	GaveUp uint64
+
+	// Incremented when a POST failed specifically because Close()
+	// cancelled the client's internal context while the request
+	// was in flight, as opposed to a transport error or a
+	// deadline.
+	ClosedDuringFlight uint64
+
+	// Bandwidth statistics
+
+	// Total bytes across all framed payloads handed to Post,
+	// counted once per bundle regardless of how many attempts it
+	// took to deliver.
+	BytesFramed uint64
+
+	// Total bytes actually placed on the wire, counted once per
+	// attempt; with retries this exceeds BytesFramed, and once
+	// this package supports compressing the wire payload it will
+	// also diverge for that reason.
+	BytesSent uint64
+
+	// Distribution of MiniClient.Post round-trip latencies, in
+	// milliseconds.
+	Latency Histogram
+}
+
+// RetryPolicy controls how syncWorker retries a POST that failed with
+// a retriable error (a transport error, or a 5xx/429 status) before
+// giving up and accounting the bundle as lost.
+type RetryPolicy struct {
+	// Maximum number of attempts per bundle, including the first.
+	// MaxAttempts <= 1 disables retrying.
+	MaxAttempts int
+
+	// Delay before the first retry.
+	InitialDelay time.Duration
+
+	// Upper bound on the backoff delay between retries. Zero
+	// means unbounded.
+	MaxDelay time.Duration
+
+	// Multiplier applied to the delay after each retry.
+	Multiplier float64
+
+	// Fraction, in [0,1], by which the delay is randomized on
+	// either side to avoid retries from many clients lining up in
+	// lockstep.
+	Jitter float64
 }
 
 type Client struct {
@@ -58,6 +152,21 @@ type Client struct {
 	// Threshold of logplex request size to trigger POST.
 	RequestSizeTrigger int
 
+	// Retry policy applied to failed POSTs in syncWorker, and the
+	// latency target retries are bounded by (mirrors
+	// Config.TargetLogLatency).
+	retry            RetryPolicy
+	targetLogLatency time.Duration
+
+	// Internal context bounding in-flight HTTP requests. Cancelled
+	// with ErrClientClosed as its cause when Close() is called.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// Sink that latency/bandwidth/counter observations are
+	// forwarded to as they happen.
+	metrics MetricsSink
+
 	// For forcing periodic posting of low-activity logs.
 	ticker *time.Ticker
 
@@ -72,6 +181,26 @@ type Config struct {
 	RequestSizeTrigger int
 	Concurrency        int
 	TargetLogLatency   time.Duration
+
+	// Retry policy for failed POSTs. The zero value disables
+	// retrying, preserving the historical behavior of counting a
+	// failed attempt as lost immediately.
+	Retry RetryPolicy
+
+	// Fraction, in [0,1], of outgoing requests that should be
+	// made to fail synthetically; see MiniConfig.FailRate. A test
+	// knob, left zero in production.
+	FailRate float64
+
+	// Pool that Bundle outboxes are drawn from and returned to;
+	// see MiniConfig.BufferPool.
+	BufferPool BufferPool
+
+	// Sink that latency, bandwidth and counter observations are
+	// forwarded to as they happen. Defaults to NopMetricsSink;
+	// Statistics() keeps working as a pull-model snapshot either
+	// way.
+	Metrics MetricsSink
 }
 
 func NewClient(cfg *Config) (*Client, error) {
@@ -80,6 +209,8 @@ func NewClient(cfg *Config) (*Client, error) {
 			Logplex:    cfg.Logplex,
 			Token:      cfg.Token,
 			HttpClient: cfg.HttpClient,
+			FailRate:   cfg.FailRate,
+			BufferPool: cfg.BufferPool,
 		})
 
 	if err != nil {
@@ -91,11 +222,28 @@ func NewClient(cfg *Config) (*Client, error) {
 			"latency not allowed")
 	}
 
+	retry := cfg.Retry
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 1
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	metrics := cfg.Metrics
+	if metrics == nil {
+		metrics = NopMetricsSink{}
+	}
+
 	m := Client{
 		c:                  c,
 		finalize:           make(chan bool),
 		bucket:             make(chan bool),
 		RequestSizeTrigger: cfg.RequestSizeTrigger,
+		retry:              retry,
+		targetLogLatency:   cfg.TargetLogLatency,
+		ctx:                ctx,
+		cancel:             cancel,
+		metrics:            metrics,
 	}
 
 	// If duration is zero, don't bother starting the ticker; a
@@ -137,15 +285,25 @@ func NewClient(cfg *Config) (*Client, error) {
 }
 
 func (m *Client) Close() {
-	// Clean up otherwise immortal ticker goroutine
-	m.ticker.Stop()
+	// Clean up otherwise immortal ticker goroutine; ticker is left
+	// nil when TargetLogLatency is zero.
+	if m.ticker != nil {
+		m.ticker.Stop()
+	}
 	close(m.finalize)
+
+	// Cancel any in-flight (or future) HTTP requests, recording
+	// why so Cause() can tell this apart from a deadline or a
+	// user cancel.
+	m.cancel(ErrClientClosed)
 }
 
 func (m *Client) BufferMessage(
-	when time.Time, procId string, log []byte) error {
+	ctx context.Context, when time.Time, host string, procId string, log []byte) error {
 
 	select {
+	case <-ctx.Done():
+		return ctx.Err()
 	case _, _ = <-m.finalize:
 		return errors.New("Failed trying to buffer a message: " +
 			"client already Closed")
@@ -156,7 +314,7 @@ func (m *Client) BufferMessage(
 	m.statLock.Lock()
 	defer m.statLock.Unlock()
 
-	s := m.c.BufferMessage(when, procId, log)
+	s := m.c.BufferMessage(when, host, procId, log)
 	if s.Buffered >= m.RequestSizeTrigger || m.ticker == nil {
 		go m.syncWorker()
 	}
@@ -194,27 +352,133 @@ func (m *Client) syncWorker() {
 		}()
 	default:
 		m.statReqDrop(&b.MiniStats)
+		m.c.ReleaseBundle(&b)
 		return
 	}
 
-	// Post to logplex.
-	resp, err := m.c.Post(&b)
+	// Post to logplex, retrying retriable failures with backoff.
+	resp, retries, err := m.postWithRetry(&b)
+	m.statBytes(b.outbox.Len(), retries+1)
+	if retries > 0 {
+		m.statRetries(uint64(retries))
+	}
+
 	if err != nil {
+		if retries > 0 {
+			m.statGaveUp(&b.MiniStats)
+		}
+		if Cause(m.ctx, err) == ErrClientClosed {
+			m.statClosedDuringFlight(&b.MiniStats)
+		}
 		m.statReqErr(&b.MiniStats)
+		m.c.ReleaseBundle(&b)
+		return
 	}
 
-	defer resp.Body.Close()
+	// The buffer is only safe to recycle once the response body
+	// (and so the whole round trip, including every retry's
+	// request body) is done being read.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	m.c.ReleaseBundle(&b)
 
 	// Check HTTP return code and accrue statistics accordingly.
 	if resp.StatusCode != http.StatusNoContent {
+		if retries > 0 {
+			m.statGaveUp(&b.MiniStats)
+		}
 		m.statReqRej(&b.MiniStats)
 	} else {
+		if retries > 0 {
+			m.statRetriedSuccess(&b.MiniStats)
+		}
 		m.statReqSuccess(&b.MiniStats)
 	}
 
 	return
 }
 
+// postWithRetry posts a bundle, retrying retriable failures according
+// to m.retry until one succeeds, the policy is exhausted, the retry
+// deadline (derived from TargetLogLatency) elapses, or the client is
+// Closed. It reports the number of retries actually performed (0 on
+// a first-attempt success or a non-retriable failure).
+func (m *Client) postWithRetry(b *Bundle) (resp *http.Response, retries int, err error) {
+	var deadline time.Time
+	if m.targetLogLatency > 0 {
+		deadline = time.Now().Add(m.targetLogLatency)
+	}
+
+	delay := m.retry.InitialDelay
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err = m.c.Post(m.ctx, b)
+		m.statLatency(time.Since(start))
+
+		if !isRetriable(resp, err) || attempt+1 >= m.retry.MaxAttempts {
+			return resp, attempt, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		wait := jitter(delay, m.retry.Jitter)
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return resp, attempt, err
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-m.finalize:
+			return resp, attempt, err
+		}
+
+		delay = time.Duration(float64(delay) * m.retry.Multiplier)
+		if m.retry.MaxDelay > 0 && delay > m.retry.MaxDelay {
+			delay = m.retry.MaxDelay
+		}
+	}
+}
+
+// isRetriable reports whether a POST attempt should be retried: a
+// transport-level error, or a 5xx/429 response.
+func isRetriable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch {
+	case resp.StatusCode >= 500:
+		return true
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	default:
+		return false
+	}
+}
+
+// jitter randomizes d by up to frac in either direction. frac is
+// clamped to [0,1]; frac <= 0 returns d unchanged.
+func jitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 {
+		return d
+	}
+	if frac > 1 {
+		frac = 1
+	}
+
+	spread := float64(d) * frac
+	return d - time.Duration(spread) + time.Duration(rand.Float64()*2*spread)
+}
+
 func (m *Client) statReqTotalUnsync(s *MiniStats) {
 	m.Total += s.NumberFramed
 	m.TotalRequests += 1
@@ -227,6 +491,7 @@ func (m *Client) statReqSuccess(s *MiniStats) {
 
 	m.Successful += s.NumberFramed
 	m.SuccessRequests += 1
+	m.metrics.IncrCounter("successful", s.NumberFramed)
 }
 
 func (m *Client) statReqErr(s *MiniStats) {
@@ -236,6 +501,7 @@ func (m *Client) statReqErr(s *MiniStats) {
 
 	m.Cancelled += s.NumberFramed
 	m.CancelRequests += 1
+	m.metrics.IncrCounter("cancelled", s.NumberFramed)
 }
 
 func (m *Client) statReqRej(s *MiniStats) {
@@ -245,6 +511,7 @@ func (m *Client) statReqRej(s *MiniStats) {
 
 	m.Rejected += s.NumberFramed
 	m.RejectRequests += 1
+	m.metrics.IncrCounter("rejected", s.NumberFramed)
 }
 
 func (m *Client) statReqDrop(s *MiniStats) {
@@ -254,4 +521,56 @@ func (m *Client) statReqDrop(s *MiniStats) {
 
 	m.Dropped += s.NumberFramed
 	m.DroppedRequests += 1
+	m.metrics.IncrCounter("dropped", s.NumberFramed)
+}
+
+func (m *Client) statRetries(n uint64) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.Retries += n
+	m.metrics.IncrCounter("retries", n)
+}
+
+func (m *Client) statRetriedSuccess(s *MiniStats) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.RetriedSuccess += s.NumberFramed
+	m.metrics.IncrCounter("retried_success", s.NumberFramed)
+}
+
+func (m *Client) statGaveUp(s *MiniStats) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.GaveUp += s.NumberFramed
+	m.metrics.IncrCounter("gave_up", s.NumberFramed)
+}
+
+func (m *Client) statClosedDuringFlight(s *MiniStats) {
+	m.statLock.Lock()
+	defer m.statLock.Unlock()
+
+	m.ClosedDuringFlight += s.NumberFramed
+	m.metrics.IncrCounter("closed_during_flight", s.NumberFramed)
+}
+
+func (m *Client) statLatency(d time.Duration) {
+	m.statLock.Lock()
+	m.Latency.observe(uint64(d.Milliseconds()))
+	m.statLock.Unlock()
+
+	m.metrics.ObserveLatency(d)
+}
+
+func (m *Client) statBytes(framedLen int, attempts int) {
+	sent := framedLen * attempts
+
+	m.statLock.Lock()
+	m.BytesFramed += uint64(framedLen)
+	m.BytesSent += uint64(sent)
+	m.statLock.Unlock()
+
+	m.metrics.ObserveBytes(sent)
 }
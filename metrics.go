@@ -0,0 +1,62 @@
+package logplexc
+
+import (
+	"math/bits"
+	"time"
+)
+
+// MetricsSink lets a caller forward Client metrics to an external
+// system (Prometheus, statsd, ...) as they happen, without this
+// package importing any such client. It's entirely optional:
+// Statistics() continues to work as a pull-model snapshot for
+// callers who don't wire one up.
+type MetricsSink interface {
+	// ObserveLatency records one MiniClient.Post round-trip's
+	// duration.
+	ObserveLatency(d time.Duration)
+
+	// ObserveBytes records bytes placed on the wire by one
+	// bundle's POST to one endpoint, summed over every attempt
+	// including retries.
+	ObserveBytes(n int)
+
+	// IncrCounter records a delta against one of the named
+	// counters also available via Stats, e.g. "successful",
+	// "rejected", "cancelled", "dropped", "retries".
+	IncrCounter(name string, delta uint64)
+}
+
+// NopMetricsSink discards everything; the default when no
+// MetricsSink is configured.
+type NopMetricsSink struct{}
+
+func (NopMetricsSink) ObserveLatency(time.Duration) {}
+func (NopMetricsSink) ObserveBytes(int)             {}
+func (NopMetricsSink) IncrCounter(string, uint64)   {}
+
+// HistogramBuckets is the number of log-scale buckets a Histogram
+// tracks: bucket 0 counts observations of 0, and bucket i > 0 counts
+// those in [2^(i-1), 2^i) of whatever unit it was fed (milliseconds,
+// for Stats.Latency); the last bucket also catches everything larger.
+const HistogramBuckets = 24
+
+// Histogram is a small fixed-bucket, log-scale distribution. It's
+// intentionally crude compared to a real metrics library: just
+// enough to eyeball the shape of a latency distribution from a pulled
+// Stats snapshot without taking on a dependency.
+type Histogram struct {
+	Buckets [HistogramBuckets]uint64
+	Count   uint64
+	Sum     uint64
+}
+
+func (h *Histogram) observe(v uint64) {
+	idx := bits.Len64(v)
+	if idx >= HistogramBuckets {
+		idx = HistogramBuckets - 1
+	}
+
+	h.Buckets[idx]++
+	h.Count++
+	h.Sum += v
+}
@@ -0,0 +1,58 @@
+package logplexc
+
+import (
+	"math/bits"
+	"testing"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	var h Histogram
+
+	values := []uint64{0, 1, 2, 3, 1000, 1 << 20, 1 << 30}
+	var wantSum uint64
+
+	for _, v := range values {
+		h.observe(v)
+		wantSum += v
+
+		wantIdx := bits.Len64(v)
+		if wantIdx >= HistogramBuckets {
+			wantIdx = HistogramBuckets - 1
+		}
+
+		if h.Buckets[wantIdx] == 0 {
+			t.Errorf("observe(%d): bucket %d not incremented: %+v", v, wantIdx, h.Buckets)
+		}
+	}
+
+	if h.Count != uint64(len(values)) {
+		t.Errorf("Count = %d, want %d", h.Count, len(values))
+	}
+	if h.Sum != wantSum {
+		t.Errorf("Sum = %d, want %d", h.Sum, wantSum)
+	}
+}
+
+// TestHistogramObserveClampsOverflow checks that a value whose
+// natural bucket index would exceed HistogramBuckets is folded into
+// the last bucket instead of panicking on an out-of-range index.
+func TestHistogramObserveClampsOverflow(t *testing.T) {
+	var h Histogram
+
+	h.observe(1 << 40)
+
+	last := HistogramBuckets - 1
+	if h.Buckets[last] != 1 {
+		t.Errorf("expected the overflow bucket %d to hold 1 observation, got %+v", last, h.Buckets)
+	}
+}
+
+// TestNopMetricsSink checks that NopMetricsSink satisfies
+// MetricsSink and that its methods are safe no-ops.
+func TestNopMetricsSink(t *testing.T) {
+	var sink MetricsSink = NopMetricsSink{}
+
+	sink.ObserveLatency(0)
+	sink.ObserveBytes(0)
+	sink.IncrCounter("successful", 1)
+}
@@ -2,7 +2,10 @@ package logplexc
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -27,6 +30,18 @@ type MiniConfig struct {
 	Logplex    url.URL
 	Token      string
 	HttpClient http.Client
+
+	// Fraction, in [0,1], of outgoing requests that should be
+	// made to fail with a synthetic transport error instead of
+	// actually being sent. Intended as a test knob for exercising
+	// retry behavior deterministically; leave zero in production.
+	FailRate float64
+
+	// Pool that Bundle outboxes are drawn from and returned to.
+	// Defaults to a tiered pool that buckets by power-of-two
+	// capacity; set to a NopBufferPool to rule the pool out when
+	// debugging buffer lifetime issues.
+	BufferPool BufferPool
 }
 
 // A bundle of messages that are either being accrued to or in the
@@ -37,7 +52,7 @@ type MiniConfig struct {
 // with bundles that have I/O in progress.
 type Bundle struct {
 	MiniStats
-	outbox bytes.Buffer
+	outbox *bytes.Buffer
 }
 
 // Client context: generally, at a minimum, one should exist per
@@ -51,16 +66,35 @@ type MiniClient struct {
 	// Messages that have been collected but not yet sent.
 	bSwapLock sync.Mutex
 	b         *Bundle
+
+	pool BufferPool
+
+	// Size, in bytes, of the outbox most recently swapped out,
+	// used as a hint for how big the next one drawn from pool is
+	// likely to need to grow.
+	lastSize int
 }
 
 func NewMiniClient(cfg *MiniConfig) (client *MiniClient, err error) {
 	c := MiniClient{}
 
-	c.b = &Bundle{outbox: bytes.Buffer{}}
-
 	// Make a private copy
 	c.MiniConfig = *cfg
 
+	c.pool = c.BufferPool
+	if c.pool == nil {
+		c.pool = NewTieredBufferPool()
+	}
+
+	c.b = &Bundle{outbox: c.pool.Get(0)}
+
+	if c.FailRate > 0 {
+		c.HttpClient.Transport = &flakyTripper{
+			rt:       c.HttpClient.Transport,
+			failRate: c.FailRate,
+		}
+	}
+
 	// If the username and password weren't part of the URL, use
 	// the logplex-token as the password
 	if c.Logplex.User == nil {
@@ -108,7 +142,7 @@ func (c *MiniClient) BufferMessage(
 		c.Token + " " + procId + " - - "
 	msgLen := len(syslogPrefix) + len(log)
 
-	fmt.Fprintf(&c.b.outbox, "%d %s%s", msgLen, syslogPrefix, log)
+	fmt.Fprintf(c.b.outbox, "%d %s%s", msgLen, syslogPrefix, log)
 	c.b.NumberFramed += 1
 	c.b.Buffered = c.b.outbox.Len()
 
@@ -122,29 +156,53 @@ func (c *MiniClient) SwapBundle() Bundle {
 	c.bSwapLock.Lock()
 	defer c.bSwapLock.Unlock()
 
-	var newB Bundle
-	var oldB Bundle
+	oldB := *c.b
+
+	sizeHint := c.lastSize
+	if oldB.outbox.Len() > sizeHint {
+		sizeHint = oldB.outbox.Len()
+	}
+	c.lastSize = oldB.outbox.Len()
 
-	oldB = *c.b
-	c.b = &newB
+	c.b = &Bundle{outbox: c.pool.Get(sizeHint)}
 
 	return oldB
 }
 
-func (c *MiniClient) Post(b *Bundle) (*http.Response, error) {
+// ReleaseBundle returns a spent Bundle's buffer to this MiniClient's
+// pool. Callers must only do this once the Bundle's POST (and every
+// retry of it) has returned and its response body has been fully
+// drained, since an earlier attempt's http.Request may otherwise
+// still be reading from the same underlying array.
+func (c *MiniClient) ReleaseBundle(b *Bundle) {
+	c.pool.Put(b.outbox)
+}
+
+func (c *MiniClient) Post(ctx context.Context, b *Bundle) (*http.Response, error) {
+	return c.PostPayload(ctx, bytes.NewReader(b.outbox.Bytes()), b.NumberFramed)
+}
+
+// PostPayload posts an already-framed payload, rather than the
+// Bundle this MiniClient itself has been accruing via
+// BufferMessage/SwapBundle. Useful when the same framed bytes need
+// to be sent through several MiniClients, e.g. a FanoutClient fanning
+// one buffer out to multiple endpoints.
+func (c *MiniClient) PostPayload(
+	ctx context.Context, payload io.Reader, numberFramed uint64) (*http.Response, error) {
+
 	// Record that a request is in progress so that a clean
 	// shutdown can wait for it to complete.
 	c.reqInFlight.Add(1)
 	defer c.reqInFlight.Done()
 
-	req, err := http.NewRequest("POST", c.Logplex.String(), &b.outbox)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Logplex.String(), payload)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Content-Type", "application/logplex-1")
 	req.Header.Add("Logplex-Msg-Count",
-		strconv.FormatUint(b.NumberFramed, 10))
+		strconv.FormatUint(numberFramed, 10))
 
 	resp, err := c.HttpClient.Do(req)
 	if err != nil {
@@ -153,3 +211,40 @@ func (c *MiniClient) Post(b *Bundle) (*http.Response, error) {
 
 	return resp, nil
 }
+
+// flakyTripper wraps a RoundTripper and deterministically fails a
+// configured fraction of requests, so that retry behavior can be
+// exercised in tests without relying on a real flaky endpoint.
+//
+// The fraction is tracked with an accumulator rather than by
+// sampling, so that e.g. FailRate 0.25 fails exactly one in every
+// four calls rather than some random-but-converging fraction of
+// them.
+type flakyTripper struct {
+	rt       http.RoundTripper
+	failRate float64
+
+	mu  sync.Mutex
+	acc float64
+}
+
+func (f *flakyTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	f.acc += f.failRate
+	fail := f.acc >= 1
+	if fail {
+		f.acc -= 1
+	}
+	f.mu.Unlock()
+
+	if fail {
+		return nil, errors.New("logplexc: injected failure (MiniConfig.FailRate)")
+	}
+
+	rt := f.rt
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	return rt.RoundTrip(req)
+}
@@ -0,0 +1,124 @@
+package logplexc
+
+import (
+	"bytes"
+	"math/bits"
+	"sync"
+)
+
+// BufferPool hands out bytes.Buffers for Bundle outboxes and takes
+// them back once a bundle's POST (and every retry of it) has
+// completed and its response body has been fully drained, so
+// SwapBundle doesn't allocate and grow a fresh buffer on every call.
+type BufferPool interface {
+	// Get returns a buffer with at least capacity size, empty and
+	// ready to write into. size may be zero, in which case an
+	// implementation-chosen default capacity is used.
+	Get(size int) *bytes.Buffer
+
+	// Put returns a buffer to the pool for reuse. Callers must not
+	// retain any reference to it afterwards, and must not call Put
+	// until nothing else (in particular, no in-flight
+	// http.Request built from an earlier attempt) can still read
+	// from it.
+	Put(buf *bytes.Buffer)
+}
+
+// NopBufferPool never recycles buffers; every Get allocates fresh and
+// every Put discards. Useful for ruling the pool in or out when
+// debugging buffer lifetime issues.
+type NopBufferPool struct{}
+
+func (NopBufferPool) Get(size int) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	if size > 0 {
+		buf.Grow(size)
+	}
+	return buf
+}
+
+func (NopBufferPool) Put(*bytes.Buffer) {}
+
+// defaultMinTierExp and defaultMaxTierExp bound the tiers a
+// tieredBufferPool keeps: 512 bytes up to 16 MiB, which comfortably
+// spans the RequestSizeTrigger values this package is used with.
+const (
+	defaultMinTierExp = 9
+	defaultMaxTierExp = 24
+)
+
+// tieredBufferPool buckets buffers by power-of-two capacity, similar
+// in spirit to grpc-go's tiered mem.BufferPool, so a buffer sized for
+// a small bundle isn't handed out to a MiniClient configured with a
+// much larger RequestSizeTrigger, and vice versa.
+type tieredBufferPool struct {
+	tiers      []sync.Pool
+	minTierExp uint
+}
+
+// NewTieredBufferPool returns the BufferPool used by default: buffers
+// are bucketed by power-of-two capacity so repeated Get/Put cycles at
+// a roughly stable bundle size settle into allocation-free reuse.
+func NewTieredBufferPool() BufferPool {
+	p := &tieredBufferPool{minTierExp: defaultMinTierExp}
+	p.tiers = make([]sync.Pool, defaultMaxTierExp-defaultMinTierExp+1)
+
+	for i := range p.tiers {
+		tierCap := 1 << (defaultMinTierExp + uint(i))
+		p.tiers[i].New = func() interface{} {
+			buf := &bytes.Buffer{}
+			buf.Grow(tierCap)
+			return buf
+		}
+	}
+
+	return p
+}
+
+func (p *tieredBufferPool) Get(size int) *bytes.Buffer {
+	buf := p.tiers[p.tierIndex(ceilLog2(size))].Get().(*bytes.Buffer)
+	buf.Reset()
+
+	if buf.Cap() < size {
+		buf.Grow(size)
+	}
+
+	return buf
+}
+
+func (p *tieredBufferPool) Put(buf *bytes.Buffer) {
+	// Bucket by the buffer's actual capacity (floor, not ceil):
+	// it's already paid for that much memory, so round down to
+	// the tier it fits in rather than the tier it was requested
+	// at, which may have grown past its tier while buffering.
+	p.tiers[p.tierIndex(floorLog2(buf.Cap()))].Put(buf)
+}
+
+func (p *tieredBufferPool) tierIndex(exp uint) int {
+	if exp < p.minTierExp {
+		exp = p.minTierExp
+	}
+
+	idx := int(exp - p.minTierExp)
+	if last := len(p.tiers) - 1; idx > last {
+		idx = last
+	}
+
+	return idx
+}
+
+// ceilLog2 returns the smallest exp such that 1<<exp >= n.
+func ceilLog2(n int) uint {
+	if n <= 1 {
+		return 0
+	}
+	return uint(bits.Len(uint(n - 1)))
+}
+
+// floorLog2 returns the largest exp such that 1<<exp <= n.
+func floorLog2(n int) uint {
+	if n <= 1 {
+		return 0
+	}
+	return uint(bits.Len(uint(n))) - 1
+}